@@ -0,0 +1,126 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// journalEntry records the restore progress for a single namespace. It is
+// appended to the journal file as the namespace progresses, so the last
+// entry for a namespace in the file reflects its current state.
+type journalEntry struct {
+	Namespace  string `json:"ns"`
+	Offset     int64  `json:"offset"`
+	SourceHash string `json:"sourceHash"`
+	DocCount   int64  `json:"docCount"`
+	Complete   bool   `json:"complete"`
+}
+
+// journal is a newline-delimited JSON progress log, written next to a dump
+// being restored, that lets a failed restore resume without re-inserting
+// documents that already made it to the target server.
+type journal struct {
+	path string
+	file *os.File
+	mu   sync.Mutex
+
+	entries map[string]journalEntry
+}
+
+// openJournal opens (creating if necessary) the journal file at path and
+// loads any progress already recorded in it.
+func openJournal(path string) (*journal, error) {
+	j := &journal{
+		path:    path,
+		entries: map[string]journalEntry{},
+	}
+
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			var entry journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				existing.Close()
+				return nil, fmt.Errorf("error parsing journal entry in %v: %v", path, err)
+			}
+			j.entries[entry.Namespace] = entry
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading journal %v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal %v for append: %v", path, err)
+	}
+	j.file = file
+	return j, nil
+}
+
+// Close releases the underlying journal file.
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// Lookup returns the most recently recorded progress for ns, if any.
+func (j *journal) Lookup(ns string) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.entries[ns]
+	return entry, ok
+}
+
+// Record appends a new progress entry for the namespace and updates the
+// in-memory view used by Lookup.
+func (j *journal) Record(entry journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries[entry.Namespace] = entry
+	return nil
+}
+
+// hashFilePrefix returns a hex-encoded SHA-256 hash of the first n bytes of
+// the file at path (or the whole file, if it is shorter than n). It is used
+// to detect that a resumed restore is reading the same source BSON file it
+// checkpointed against, rather than a regenerated dump with different
+// contents at the same path.
+func hashFilePrefix(path string, n int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, n); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,291 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	"github.com/mongodb/mongo-tools/common/log"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// minUUIDFeatureCompatibilityVersion is the lowest featureCompatibilityVersion
+// that supports collections carrying an explicit UUID.
+const minUUIDFeatureCompatibilityVersion = "3.6"
+
+// IndexDocument describes an index as recorded in a mongodump metadata file.
+type IndexDocument struct {
+	Options bson.M `bson:",inline"`
+	Key     bson.D `bson:"key"`
+}
+
+// CollectionMetadata holds the contents of a collection's *.metadata.json
+// file: its creation options, its indexes, and, if the dump was taken with
+// UUID support, the collection's original UUID.
+type CollectionMetadata struct {
+	Options bson.D          `json:"options"`
+	Indexes []IndexDocument `json:"indexes"`
+	UUID    string          `json:"uuid"`
+}
+
+// parseMetadata reads and unmarshals a metadata document off of r, in the
+// same JSON layout as mongodump's *.metadata.json files.
+func parseMetadata(r io.Reader) (*CollectionMetadata, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Options bson.M          `json:"options"`
+		Indexes []IndexDocument `json:"indexes"`
+		UUID    string          `json:"uuid"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing metadata: %v", err)
+	}
+
+	converted, err := bsonutil.ConvertJSONValueToBSON(raw.Options)
+	if err != nil {
+		return nil, fmt.Errorf("error converting collection options: %v", err)
+	}
+
+	optionsDoc := bson.D{}
+	for k, v := range converted.(bson.M) {
+		optionsDoc = append(optionsDoc, bson.DocElem{Name: k, Value: v})
+	}
+
+	return &CollectionMetadata{
+		Options: optionsDoc,
+		Indexes: raw.Indexes,
+		UUID:    raw.UUID,
+	}, nil
+}
+
+// CreateCollection ensures dbName.collName exists on the target server with
+// the options recorded in meta, applying the recorded UUID when
+// --preserveUUID was requested.
+func (restore *MongoRestore) CreateCollection(dbName, collName string, meta *CollectionMetadata) error {
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	exists, existingUUID, err := restore.collectionUUID(session, dbName, collName)
+	if err != nil {
+		return err
+	}
+
+	var options bson.D
+	if !restore.OutputOptions.NoOptionsRestore {
+		options = meta.Options
+	}
+
+	if !restore.OutputOptions.PreserveUUID || meta.UUID == "" {
+		if exists {
+			if !restore.OutputOptions.Drop {
+				return nil
+			}
+			if err := session.DB(dbName).C(collName).DropCollection(); err != nil {
+				return fmt.Errorf("error dropping %v.%v: %v", dbName, collName, err)
+			}
+		}
+		createCmd := append(bson.D{{Name: "create", Value: collName}}, options...)
+		return session.DB(dbName).Run(createCmd, nil)
+	}
+
+	fcvOK, err := restore.hasUUIDSupport(session)
+	if err != nil {
+		return err
+	}
+	if !fcvOK {
+		return fmt.Errorf("cannot preserve UUID for %v.%v: the target server's "+
+			"featureCompatibilityVersion must be %v or newer", dbName, collName, minUUIDFeatureCompatibilityVersion)
+	}
+
+	if exists {
+		if existingUUID == meta.UUID && !restore.OutputOptions.Drop {
+			// Already the right collection with the right UUID; nothing to do.
+			return nil
+		}
+		if !restore.OutputOptions.Drop {
+			return fmt.Errorf("cannot preserve UUID for %v.%v: collection already "+
+				"exists with a different UUID, specify --drop to replace it", dbName, collName)
+		}
+		if err := session.DB(dbName).C(collName).DropCollection(); err != nil {
+			return fmt.Errorf("error dropping %v.%v before UUID restore: %v", dbName, collName, err)
+		}
+	}
+
+	return restore.createCollectionWithUUID(session, dbName, collName, meta.UUID, options)
+}
+
+// createCollectionWithUUID creates dbName.collName carrying the given UUID
+// by issuing the create through applyOps, since the plain "create" command
+// does not accept a caller-supplied UUID.
+func (restore *MongoRestore) createCollectionWithUUID(session *mgo.Session, dbName, collName, uuidHex string, options bson.D) error {
+	uuidBytes, err := bsonutil.ParseUUID(uuidHex)
+	if err != nil {
+		return fmt.Errorf("invalid collection UUID %q for %v.%v: %v", uuidHex, dbName, collName, err)
+	}
+
+	op := bson.D{
+		{Name: "op", Value: "c"},
+		{Name: "ns", Value: dbName + ".$cmd"},
+		{Name: "ui", Value: uuidBytes},
+		{Name: "o", Value: append(bson.D{{Name: "create", Value: collName}}, options...)},
+	}
+	applyOpsCmd := bson.D{{Name: "applyOps", Value: []bson.D{op}}}
+
+	log.Logvf(log.DebugLow, "applying create op with UUID %v for %v.%v", uuidHex, dbName, collName)
+	return session.DB(dbName).Run(applyOpsCmd, nil)
+}
+
+// collectionUUID reports whether dbName.collName already exists, and if so,
+// the UUID it currently carries (which may be empty on pre-3.6 servers).
+func (restore *MongoRestore) collectionUUID(session *mgo.Session, dbName, collName string) (exists bool, uuid string, err error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Name string `bson:"name"`
+				Info struct {
+					UUID bson.Binary `bson:"uuid"`
+				} `bson:"info"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+
+	cmd := bson.D{{Name: "listCollections", Value: 1}, {Name: "filter", Value: bson.D{{Name: "name", Value: collName}}}}
+	if err := session.DB(dbName).Run(cmd, &result); err != nil {
+		return false, "", err
+	}
+	for _, c := range result.Cursor.FirstBatch {
+		if c.Name == collName {
+			return true, hex.EncodeToString(c.Info.UUID.Data), nil
+		}
+	}
+	return false, "", nil
+}
+
+// hasUUIDSupport reports whether the target server's
+// featureCompatibilityVersion is new enough to accept collection UUIDs.
+func (restore *MongoRestore) hasUUIDSupport(session *mgo.Session) (bool, error) {
+	var result struct {
+		FeatureCompatibilityVersion struct {
+			Version string `bson:"version"`
+		} `bson:"featureCompatibilityVersion"`
+	}
+	cmd := bson.D{{Name: "getParameter", Value: 1}, {Name: "featureCompatibilityVersion", Value: 1}}
+	if err := session.DB("admin").Run(cmd, &result); err != nil {
+		return false, err
+	}
+	return fcvAtLeast(result.FeatureCompatibilityVersion.Version, minUUIDFeatureCompatibilityVersion)
+}
+
+// fcvAtLeast reports whether version is at least min, comparing
+// "major.minor" featureCompatibilityVersion strings numerically rather
+// than lexicographically: lexicographic comparison breaks as soon as a
+// component reaches two digits (e.g. "3.10" < "3.6" as plain strings).
+func fcvAtLeast(version, min string) (bool, error) {
+	v, err := parseFCV(version)
+	if err != nil {
+		return false, fmt.Errorf("error parsing featureCompatibilityVersion %q: %v", version, err)
+	}
+	m, err := parseFCV(min)
+	if err != nil {
+		return false, fmt.Errorf("error parsing featureCompatibilityVersion %q: %v", min, err)
+	}
+	if v[0] != m[0] {
+		return v[0] > m[0], nil
+	}
+	return v[1] >= m[1], nil
+}
+
+// parseFCV splits a "major.minor" featureCompatibilityVersion string into
+// its two numeric components.
+func parseFCV(version string) ([2]int, error) {
+	parts := strings.SplitN(version, ".", 2)
+	if len(parts) != 2 {
+		return [2]int{}, fmt.Errorf("expected \"major.minor\", got %q", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return [2]int{}, err
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return [2]int{}, err
+	}
+	return [2]int{major, minor}, nil
+}
+
+// CreateIndexes builds the given indexes on dbName.collName.
+func (restore *MongoRestore) CreateIndexes(dbName, collName string, indexes []IndexDocument) error {
+	if restore.OutputOptions.NoIndexRestore || len(indexes) == 0 {
+		return nil
+	}
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	coll := session.DB(dbName).C(collName)
+	for _, idx := range indexes {
+		mgoIndex, err := idx.mgoIndex()
+		if err != nil {
+			return fmt.Errorf("error interpreting index %v on %v.%v: %v", idx.Key, dbName, collName, err)
+		}
+		if err := coll.EnsureIndex(mgoIndex); err != nil {
+			return fmt.Errorf("error creating index %v on %v.%v: %v", idx.Key, dbName, collName, err)
+		}
+	}
+	return nil
+}
+
+// mgoIndex converts the dump's representation of an index into the form the
+// driver expects to build it.
+func (idx IndexDocument) mgoIndex() (mgo.Index, error) {
+	keys := make([]string, 0, len(idx.Key))
+	for _, elem := range idx.Key {
+		prefix := ""
+		switch v := elem.Value.(type) {
+		case int, int32, int64, float64:
+			if fmt.Sprintf("%v", v) == "-1" {
+				prefix = "-"
+			}
+		case string:
+			// text/geo index specifiers are passed through as-is.
+			keys = append(keys, "$"+v+":"+elem.Name)
+			continue
+		}
+		keys = append(keys, prefix+elem.Name)
+	}
+
+	name, _ := idx.Options["name"].(string)
+	unique, _ := idx.Options["unique"].(bool)
+	sparse, _ := idx.Options["sparse"].(bool)
+	background, _ := idx.Options["background"].(bool)
+
+	return mgo.Index{
+		Key:        keys,
+		Name:       name,
+		Unique:     unique,
+		Sparse:     sparse,
+		Background: background,
+	}, nil
+}
@@ -14,10 +14,17 @@ import (
 	"github.com/mongodb/mongo-tools/common/testutil"
 	"github.com/mongodb/mongo-tools/common/util"
 
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func init() {
@@ -134,6 +141,64 @@ func TestRestoreUsersOrRoles(t *testing.T) {
 	})
 }
 
+// TestPreserveUUID exercises --preserveUUID against whatever
+// featureCompatibilityVersion the test server actually has, rather than
+// forcing a particular FCV: flipping a live server's FCV is disruptive
+// enough that CI runs are expected to provide one or the other, and each
+// sub-test skips itself when the ambient FCV doesn't match what it needs.
+func TestPreserveUUID(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	Convey("With a test MongoRestore using --preserveUUID", t, func() {
+		restore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				PreserveUUID:           true,
+				Drop:                   true,
+			},
+			InputOptions:    &InputOptions{},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+			TargetDirectory: "testdata/uuiddump",
+		}
+
+		session, _ := provider.GetSession()
+		defer session.Close()
+		session.DB("db1").C("c1").DropCollection()
+
+		fcvOK, err := restore.hasUUIDSupport(session)
+		So(err, ShouldBeNil)
+
+		Convey("on a server with FCV >= 3.6, the dump's UUID is applied", func() {
+			if !fcvOK {
+				t.Skip("requires a server with featureCompatibilityVersion >= 3.6")
+			}
+			err := restore.Restore()
+			So(err, ShouldBeNil)
+
+			_, uuid, err := restore.collectionUUID(session, "db1", "c1")
+			So(err, ShouldBeNil)
+			So(uuid, ShouldNotBeEmpty)
+		})
+
+		Convey("on a server with FCV < 3.6, --preserveUUID is rejected", func() {
+			if fcvOK {
+				t.Skip("requires a server with featureCompatibilityVersion < 3.6")
+			}
+			err := restore.Restore()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 func TestKnownCollections(t *testing.T) {
 	testtype.VerifyTestType(t, testtype.IntegrationTestType)
 
@@ -179,5 +244,475 @@ func TestKnownCollections(t *testing.T) {
 			}
 			So(namespaceExistsInCache, ShouldBeTrue)
 		})
+
+		Convey("A dry run also populates restore.knownCollections, but inserts no documents", func() {
+			So(db.C("foo").Insert(bson.M{"_id": "sentinel"}), ShouldBeNil)
+			restore.OutputOptions.DryRun = true
+			restore.TargetDirectory = "testdata/foodump"
+			err := restore.Restore()
+			So(err, ShouldBeNil)
+
+			var namespaceExistsInCache bool
+			if cols, ok := restore.knownCollections["test"]; ok {
+				for _, collName := range cols {
+					if collName == "foo" {
+						namespaceExistsInCache = true
+					}
+				}
+			}
+			So(namespaceExistsInCache, ShouldBeTrue)
+
+			count, err := db.C("foo").Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestDryRunUsersDump(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	Convey("With a dry-run MongoRestore over testdata/usersdump", t, func() {
+		restore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				TempUsersColl:          "tempusers",
+				TempRolesColl:          "temproles",
+				DryRun:                 true,
+			},
+			InputOptions:    &InputOptions{},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+			TargetDirectory: "testdata/usersdump",
+		}
+
+		Convey("the plan lists drop intents for tempusers and temproles", func() {
+			old := os.Stdout
+			r, w, err := os.Pipe()
+			So(err, ShouldBeNil)
+			os.Stdout = w
+
+			restoreErr := restore.Restore()
+
+			w.Close()
+			os.Stdout = old
+			out, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(restoreErr, ShouldBeNil)
+
+			var plan RestorePlan
+			So(json.Unmarshal(out, &plan), ShouldBeNil)
+
+			var sawTempUsersWarning, sawTempRolesWarning bool
+			for _, ns := range plan.Namespaces {
+				switch ns.Namespace {
+				case "admin.tempusers":
+					sawTempUsersWarning = len(ns.Warnings) > 0
+				case "admin.temproles":
+					sawTempRolesWarning = len(ns.Warnings) > 0
+				}
+			}
+			So(sawTempUsersWarning, ShouldBeTrue)
+			So(sawTempRolesWarning, ShouldBeTrue)
+		})
+	})
+}
+
+func TestResumableRestore(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	nsOptions := &NSOptions{}
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	Convey("With a test MongoRestore using a checkpoint journal", t, func() {
+		journalDir, err := ioutil.TempDir("", "mongorestore_journal")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(journalDir)
+		journalPath := filepath.Join(journalDir, "resume.journal")
+
+		outputOptions := &OutputOptions{
+			NumParallelCollections: 1,
+			NumInsertionWorkers:    1,
+			Checkpoint:             true,
+		}
+		restore := MongoRestore{
+			ToolOptions:     toolOpts,
+			OutputOptions:   outputOptions,
+			InputOptions:    &InputOptions{},
+			NSOptions:       nsOptions,
+			SessionProvider: provider,
+			TargetDirectory: "testdata/testdirs",
+		}
+		restore.OutputOptions.ResumeFrom = journalPath
+
+		session, _ := provider.GetSession()
+		defer session.Close()
+		c1 := session.DB("db1").C("c1")
+		c1.DropCollection()
+
+		Convey("a completed restore re-run from its journal is a no-op and doesn't duplicate documents", func() {
+			err = restore.Restore()
+			So(err, ShouldBeNil)
+
+			count, err := c1.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 100)
+
+			// Re-running against the now-complete journal should be a no-op:
+			// every namespace is already marked complete.
+			resumed := MongoRestore{
+				ToolOptions:     toolOpts,
+				OutputOptions:   outputOptions,
+				InputOptions:    &InputOptions{},
+				NSOptions:       nsOptions,
+				SessionProvider: provider,
+				TargetDirectory: "testdata/testdirs",
+			}
+			err = resumed.Restore()
+			So(err, ShouldBeNil)
+
+			count, err = c1.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 100)
+		})
+
+		Convey("a restore that actually crashes mid-namespace resumes from its last checkpoint without duplicating documents", func() {
+			origBatchSize := checkpointBatchSize
+			checkpointBatchSize = 10
+			defer func() { checkpointBatchSize = origBatchSize }()
+
+			restore.crashAfterDocs = 42
+			err = restore.Restore()
+			So(err, ShouldEqual, errSimulatedCrash)
+
+			count, err := c1.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldBeLessThan, 100)
+
+			resumed := MongoRestore{
+				ToolOptions:     toolOpts,
+				OutputOptions:   outputOptions,
+				InputOptions:    &InputOptions{},
+				NSOptions:       nsOptions,
+				SessionProvider: provider,
+				TargetDirectory: "testdata/testdirs",
+			}
+			err = resumed.Restore()
+			So(err, ShouldBeNil)
+
+			count, err = c1.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 100)
+		})
+	})
+}
+
+// TestResumedRestoreMergesUsersAndRoles guards against a gap in the
+// checkpoint/resume path: a process that crashes after admin.tempusers and
+// admin.temproles finish restoring, but before mergeUsersAndRoles runs,
+// marks both namespaces Complete in the journal. On resume, that Complete
+// flag makes restoreNamespaceFromSource skip them outright, so
+// mergeUsersAndRoles must still learn they exist (via noteKnownCollection
+// on the skip path) or it silently no-ops and leaves tempusers/temproles
+// unmerged and undropped.
+func TestResumedRestoreMergesUsersAndRoles(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	nsOptions := &NSOptions{}
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	Convey("With a journal that already marks tempusers/temproles complete", t, func() {
+		journalDir, err := ioutil.TempDir("", "mongorestore_journal")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(journalDir)
+		journalPath := filepath.Join(journalDir, "resume.journal")
+
+		j, err := openJournal(journalPath)
+		So(err, ShouldBeNil)
+		So(j.Record(journalEntry{Namespace: "admin.tempusers", Complete: true}), ShouldBeNil)
+		So(j.Record(journalEntry{Namespace: "admin.temproles", Complete: true}), ShouldBeNil)
+		So(j.Close(), ShouldBeNil)
+
+		session, _ := provider.GetSession()
+		defer session.Close()
+		db := session.DB("admin")
+
+		// Simulate the prior run having actually inserted these, as it
+		// would have before crashing.
+		So(db.C("tempusers").Insert(bson.M{"_id": "admin.testresumeuser", "user": "testresumeuser", "db": "admin", "roles": []bson.M{}}), ShouldBeNil)
+		So(db.C("temproles").Insert(bson.M{"_id": "admin.testresumerole", "role": "testresumerole", "db": "admin", "privileges": []bson.M{}, "roles": []bson.M{}}), ShouldBeNil)
+		defer db.C("system.users").RemoveId("admin.testresumeuser")
+		defer db.C("system.roles").RemoveId("admin.testresumerole")
+
+		restore := MongoRestore{
+			ToolOptions:  toolOpts,
+			InputOptions: &InputOptions{},
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				Checkpoint:             true,
+				ResumeFrom:             journalPath,
+				TempUsersColl:          "tempusers",
+				TempRolesColl:          "temproles",
+			},
+			NSOptions:       nsOptions,
+			SessionProvider: provider,
+			TargetDirectory: "testdata/usersdump",
+		}
+
+		Convey("resuming still merges the already-complete temp collections and drops them", func() {
+			err := restore.Restore()
+			So(err, ShouldBeNil)
+
+			var user bson.M
+			So(db.C("system.users").FindId("admin.testresumeuser").One(&user), ShouldBeNil)
+
+			var role bson.M
+			So(db.C("system.roles").FindId("admin.testresumerole").One(&role), ShouldBeNil)
+
+			adminCollections, err := db.CollectionNames()
+			So(err, ShouldBeNil)
+			for _, collName := range adminCollections {
+				So(collName, ShouldNotEqual, "tempusers")
+				So(collName, ShouldNotEqual, "temproles")
+			}
+		})
+	})
+}
+
+// TestMongorestoreFromMinIO restores the same dump as TestMongorestore, but
+// reads it out of an S3-compatible MinIO bucket via the s3:// RestoreSource
+// rather than local disk. It's gated on MONGORESTORE_TEST_MINIO_ENDPOINT
+// since it requires a MinIO server seeded with testdata/testdirs, which
+// isn't available in ordinary test runs.
+func TestMongorestoreFromMinIO(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	endpoint := os.Getenv("MONGORESTORE_TEST_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MONGORESTORE_TEST_MINIO_ENDPOINT not set, skipping MinIO-backed restore test")
+	}
+	os.Setenv("MONGORESTORE_S3_ENDPOINT", endpoint)
+	defer os.Unsetenv("MONGORESTORE_S3_ENDPOINT")
+
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	Convey("With a test MongoRestore reading from a MinIO bucket", t, func() {
+		restore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+			},
+			InputOptions:    &InputOptions{},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+			TargetDirectory: "s3://mongorestore-test/testdirs",
+		}
+
+		session, _ := provider.GetSession()
+		defer session.Close()
+		c1 := session.DB("db1").C("c1")
+		c1.DropCollection()
+
+		Convey("restores the bucket's contents the same as a local directory would", func() {
+			err = restore.Restore()
+			So(err, ShouldBeNil)
+			count, err := c1.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 100)
+		})
+	})
+}
+
+func TestParallelOplogReplay(t *testing.T) {
+	testtype.VerifyTestType(t, testtype.IntegrationTestType)
+
+	provider, toolOpts, err := testutil.GetBareSessionProvider()
+	if err != nil {
+		log.Logvf(log.Always, "error connecting to host: %v", err)
+		os.Exit(util.ExitError)
+	}
+
+	oplogCollNames := func(collCount int) []string {
+		names := make([]string, collCount)
+		for i := range names {
+			names[i] = fmt.Sprintf("oplogColl%d", i)
+		}
+		return names
+	}
+
+	// buildOplog generates interleaved CRUD across collCount distinct
+	// collections: opsPerColl inserts, a third of which are immediately
+	// followed by an update, and every fifth immediately followed by a
+	// delete, so ops on different namespaces are free to race while ops on
+	// the same _id must still apply in the order they were recorded.
+	buildOplog := func(collCount, opsPerColl int) []bson.D {
+		var ops []bson.D
+		ts := 1
+		for i := 0; i < collCount; i++ {
+			ns := "db1." + oplogCollNames(collCount)[i]
+			for j := 0; j < opsPerColl; j++ {
+				id := i*opsPerColl + j
+				ops = append(ops, bson.D{
+					{Name: "ts", Value: bson.MongoTimestamp(ts)},
+					{Name: "op", Value: "i"},
+					{Name: "ns", Value: ns},
+					{Name: "o", Value: bson.D{{Name: "_id", Value: id}, {Name: "n", Value: j}}},
+				})
+				ts++
+				if j%3 == 0 {
+					ops = append(ops, bson.D{
+						{Name: "ts", Value: bson.MongoTimestamp(ts)},
+						{Name: "op", Value: "u"},
+						{Name: "ns", Value: ns},
+						{Name: "o", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "n", Value: j * 10}}}}},
+						{Name: "o2", Value: bson.D{{Name: "_id", Value: id}}},
+					})
+					ts++
+				}
+				if j%5 == 4 {
+					ops = append(ops, bson.D{
+						{Name: "ts", Value: bson.MongoTimestamp(ts)},
+						{Name: "op", Value: "d"},
+						{Name: "ns", Value: ns},
+						{Name: "o", Value: bson.D{{Name: "_id", Value: id}}},
+					})
+					ts++
+				}
+			}
+		}
+		return ops
+	}
+
+	writeOplogBSON := func(ops []bson.D) []byte {
+		var buf []byte
+		for _, op := range ops {
+			raw, err := bson.Marshal(op)
+			So(err, ShouldBeNil)
+			buf = append(buf, raw...)
+		}
+		return buf
+	}
+
+	// collState returns, per collection name, every surviving document
+	// sorted by _id, so two replays of the same oplog can be compared for
+	// equivalence regardless of insertion order.
+	collState := func(session *mgo.Session, collNames []string) map[string][]bson.M {
+		state := map[string][]bson.M{}
+		for _, collName := range collNames {
+			var docs []bson.M
+			err := session.DB("db1").C(collName).Find(nil).Sort("_id").All(&docs)
+			So(err, ShouldBeNil)
+			state[collName] = docs
+		}
+		return state
+	}
+
+	Convey("Replaying an oplog with interleaved CRUD across many collections in parallel matches the serial result", t, func() {
+		session, _ := provider.GetSession()
+		defer session.Close()
+
+		collNames := oplogCollNames(5)
+		dropAll := func() {
+			for _, collName := range collNames {
+				session.DB("db1").C(collName).DropCollection()
+			}
+		}
+
+		ops := buildOplog(5, 20)
+		buf := writeOplogBSON(ops)
+
+		dropAll()
+		parallelRestore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				OplogParallelism:       8,
+			},
+			InputOptions:    &InputOptions{OplogReplay: true},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+		}
+		err := parallelRestore.RestoreOplog(bytes.NewReader(buf))
+		So(err, ShouldBeNil)
+		parallelState := collState(session, collNames)
+
+		dropAll()
+		serialRestore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				OplogParallelism:       1,
+			},
+			InputOptions:    &InputOptions{OplogReplay: true},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+		}
+		err = serialRestore.RestoreOplog(bytes.NewReader(buf))
+		So(err, ShouldBeNil)
+		serialState := collState(session, collNames)
+
+		So(parallelState, ShouldResemble, serialState)
+	})
+
+	Convey("A conflicting update sequence on one document still produces a deterministic result", t, func() {
+		session, _ := provider.GetSession()
+		defer session.Close()
+		coll := session.DB("db1").C("oplogConflict")
+		coll.DropCollection()
+		So(coll.Insert(bson.M{"_id": 1, "x": 0}), ShouldBeNil)
+
+		var ops []bson.D
+		for i := 1; i <= 50; i++ {
+			ops = append(ops, bson.D{
+				{Name: "ts", Value: bson.MongoTimestamp(i)},
+				{Name: "op", Value: "u"},
+				{Name: "ns", Value: "db1.oplogConflict"},
+				{Name: "o", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "x", Value: i}}}}},
+				{Name: "o2", Value: bson.D{{Name: "_id", Value: 1}}},
+			})
+		}
+		buf := writeOplogBSON(ops)
+
+		restore := MongoRestore{
+			ToolOptions: toolOpts,
+			OutputOptions: &OutputOptions{
+				NumParallelCollections: 1,
+				NumInsertionWorkers:    1,
+				OplogParallelism:       8,
+			},
+			InputOptions:    &InputOptions{OplogReplay: true},
+			NSOptions:       &NSOptions{},
+			SessionProvider: provider,
+		}
+		err := restore.RestoreOplog(bytes.NewReader(buf))
+		So(err, ShouldBeNil)
+
+		var result bson.M
+		So(coll.FindId(1).One(&result), ShouldBeNil)
+		So(result["x"], ShouldEqual, 50)
 	})
 }
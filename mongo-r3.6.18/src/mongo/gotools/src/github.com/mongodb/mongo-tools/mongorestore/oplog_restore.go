@@ -0,0 +1,220 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mongodb/mongo-tools/common/log"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogOp is a single decoded entry from an oplog dump, in the subset of
+// fields RestoreOplog needs to reapply it and to reason about what it
+// conflicts with.
+type oplogOp struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Op        string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.D              `bson:"o"`
+	Object2   bson.D              `bson:"o2,omitempty"`
+}
+
+// isBarrier reports whether op must drain all other in-flight ops before
+// (and after) it runs. DDL ("c" - create/drop/rename/collMod/...) and
+// transaction/applyOps entries can touch or depend on arbitrarily many
+// documents, so they can't safely be reordered around other concurrent ops.
+func (op *oplogOp) isBarrier() bool {
+	return op.Op == "c"
+}
+
+// dependencyKey identifies the document op touches, so that ops touching
+// the same document can be serialized relative to one another while ops on
+// different documents run concurrently. Updates carry their match in o2;
+// inserts and deletes carry it in o.
+func (op *oplogOp) dependencyKey() (string, bool) {
+	id, ok := lookupID(op.Object2)
+	if !ok {
+		id, ok = lookupID(op.Object)
+	}
+	if !ok {
+		return "", false
+	}
+	return op.Namespace + "|" + fmt.Sprintf("%v", id), true
+}
+
+// lookupID returns the value of the "_id" element in doc, if present.
+func lookupID(doc bson.D) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == "_id" {
+			return elem.Value, true
+		}
+	}
+	return interface{}(nil), false
+}
+
+// RestoreOplog replays the oplog entries read from in against the target
+// server. Entries are applied in parallel across up to
+// OutputOptions.OplogParallelism workers: a lightweight dependency graph,
+// keyed by (ns, _id), lets unrelated ops run concurrently while ops
+// touching the same document are serialized in the order they were
+// recorded. DDL and transaction/applyOps entries act as barriers, draining
+// every in-flight op before they run and before anything after them starts.
+func (restore *MongoRestore) RestoreOplog(in io.Reader) error {
+	limitTS, hasLimit, err := parseOplogLimit(restore.InputOptions.OplogLimit)
+	if err != nil {
+		return fmt.Errorf("error parsing --oplogLimit: %v", err)
+	}
+
+	parallelism := restore.OutputOptions.OplogParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	sem := make(chan struct{}, parallelism)
+	// chains holds, for each dependency key, the completion channel of the
+	// most recently dispatched op on that key. Chaining each new op's wait
+	// on the previous op's channel forms a per-key FIFO: since the main
+	// loop dispatches ops (and so updates chains) strictly in file order,
+	// an op can never start before the op recorded ahead of it for the
+	// same key finishes, regardless of goroutine scheduling. A plain
+	// mutex can't give this guarantee, since Go makes no ordering promise
+	// among goroutines contending for the same lock.
+	chains := map[string]chan struct{}{}
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	var opsApplied, opsSkipped int
+	for {
+		raw, err := readBSONDocument(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var op oplogOp
+		if err := bson.Unmarshal(raw, &op); err != nil {
+			return err
+		}
+		if hasLimit && op.Timestamp >= limitTS {
+			break
+		}
+		if op.Op == "n" {
+			// No-op entries (e.g. periodic keepalives) carry nothing to apply.
+			opsSkipped++
+			continue
+		}
+
+		if op.isBarrier() {
+			wg.Wait()
+			if firstErr != nil {
+				return firstErr
+			}
+			if err := restore.applyOplogOp(&op); err != nil {
+				return fmt.Errorf("error applying DDL op on %v: %v", op.Namespace, err)
+			}
+			opsApplied++
+			continue
+		}
+
+		if firstErr != nil {
+			break
+		}
+
+		key, hasKey := op.dependencyKey()
+		var prevDone, done chan struct{}
+		if hasKey {
+			prevDone = chains[key]
+			done = make(chan struct{})
+			chains[key] = done
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(op oplogOp, prevDone, done chan struct{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if done != nil {
+				defer close(done)
+			}
+			if prevDone != nil {
+				<-prevDone
+			}
+			if err := restore.applyOplogOp(&op); err != nil {
+				setErr(fmt.Errorf("error applying op on %v: %v", op.Namespace, err))
+			}
+		}(op, prevDone, done)
+		opsApplied++
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	log.Logvf(log.Info, "applied %v oplog entries (%v skipped) with parallelism %v", opsApplied, opsSkipped, parallelism)
+	return nil
+}
+
+// applyOplogOp reapplies a single oplog entry on the target server via
+// applyOps, which accepts the raw op format without needing to translate
+// it back into an insert/update/delete call.
+func (restore *MongoRestore) applyOplogOp(op *oplogOp) error {
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	rawOp := bson.D{
+		{Name: "op", Value: op.Op},
+		{Name: "ns", Value: op.Namespace},
+		{Name: "o", Value: op.Object},
+	}
+	if len(op.Object2) > 0 {
+		rawOp = append(rawOp, bson.DocElem{Name: "o2", Value: op.Object2})
+	}
+
+	return session.DB("admin").Run(bson.D{{Name: "applyOps", Value: []bson.D{rawOp}}}, nil)
+}
+
+// parseOplogLimit parses the "seconds[:ordinal]" format accepted by
+// --oplogLimit into a bson.MongoTimestamp. An empty input means no limit.
+func parseOplogLimit(limit string) (bson.MongoTimestamp, bool, error) {
+	if limit == "" {
+		return 0, false, nil
+	}
+
+	parts := strings.SplitN(limit, ":", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid seconds component %q", parts[0])
+	}
+
+	var ordinal int64
+	if len(parts) == 2 {
+		ordinal, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid ordinal component %q", parts[1])
+		}
+	}
+
+	return bson.MongoTimestamp(seconds<<32 | ordinal), true, nil
+}
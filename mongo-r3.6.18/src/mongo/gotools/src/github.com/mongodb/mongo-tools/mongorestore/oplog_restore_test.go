@@ -0,0 +1,79 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOplogOpIsBarrier(t *testing.T) {
+	cases := []struct {
+		op       string
+		isBarrer bool
+	}{
+		{"i", false},
+		{"u", false},
+		{"d", false},
+		{"n", false},
+		{"c", true},
+	}
+	for _, c := range cases {
+		op := &oplogOp{Op: c.op}
+		if got := op.isBarrier(); got != c.isBarrer {
+			t.Errorf("isBarrier() for op %q = %v, want %v", c.op, got, c.isBarrer)
+		}
+	}
+}
+
+func TestOplogOpDependencyKey(t *testing.T) {
+	insert := &oplogOp{
+		Op:        "i",
+		Namespace: "test.foo",
+		Object:    bson.D{{Name: "_id", Value: 1}, {Name: "x", Value: 2}},
+	}
+	key, ok := insert.dependencyKey()
+	if !ok || key != "test.foo|1" {
+		t.Errorf("dependencyKey() for insert = (%q, %v), want (\"test.foo|1\", true)", key, ok)
+	}
+
+	update := &oplogOp{
+		Op:        "u",
+		Namespace: "test.foo",
+		Object:    bson.D{{Name: "$set", Value: bson.D{{Name: "x", Value: 3}}}},
+		Object2:   bson.D{{Name: "_id", Value: 1}},
+	}
+	key, ok = update.dependencyKey()
+	if !ok || key != "test.foo|1" {
+		t.Errorf("dependencyKey() for update = (%q, %v), want (\"test.foo|1\", true)", key, ok)
+	}
+
+	noID := &oplogOp{Op: "u", Namespace: "test.foo", Object: bson.D{{Name: "$set", Value: 1}}}
+	if _, ok := noID.dependencyKey(); ok {
+		t.Errorf("dependencyKey() for op with no _id should report ok=false")
+	}
+}
+
+func TestParseOplogLimit(t *testing.T) {
+	if _, hasLimit, err := parseOplogLimit(""); err != nil || hasLimit {
+		t.Fatalf("parseOplogLimit(\"\") = (_, %v, %v), want (_, false, nil)", hasLimit, err)
+	}
+
+	ts, hasLimit, err := parseOplogLimit("100:5")
+	if err != nil || !hasLimit {
+		t.Fatalf("parseOplogLimit(\"100:5\") returned err=%v hasLimit=%v", err, hasLimit)
+	}
+	want := bson.MongoTimestamp(int64(100)<<32 | 5)
+	if ts != want {
+		t.Errorf("parseOplogLimit(\"100:5\") = %v, want %v", ts, want)
+	}
+
+	if _, _, err := parseOplogLimit("not-a-number"); err == nil {
+		t.Errorf("parseOplogLimit(\"not-a-number\") should return an error")
+	}
+}
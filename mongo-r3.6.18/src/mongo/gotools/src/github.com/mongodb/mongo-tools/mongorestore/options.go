@@ -0,0 +1,68 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+// InputOptions defines the set of options to use in configuring the input
+// to mongorestore.
+type InputOptions struct {
+	Objcheck               bool   `long:"objcheck" description:"validate all objects before inserting"`
+	OplogReplay            bool   `long:"oplogReplay" description:"replay oplog for point-in-time restore"`
+	OplogLimit             string `long:"oplogLimit" description:"only include oplog entries before the provided Timestamp (seconds[:ordinal])"`
+	OplogFile              string `long:"oplogFile" description:"oplog file to use for replay of oplog"`
+	Archive                string `long:"archive" value-name:"<filename>" description:"restore dump from the specified archive file. If flag is specified without a value, archive is read from stdin"`
+	RestoreDBUsersAndRoles bool   `long:"restoreDbUsersAndRoles" description:"restore user and role definitions for the given database"`
+	Directory              string `long:"dir" description:"input directory, use '-' for stdin"`
+}
+
+// Name returns a human-readable name for the input options.
+func (*InputOptions) Name() string {
+	return "input"
+}
+
+// OutputOptions defines the set of options to use in configuring how
+// mongorestore writes data to the target deployment.
+type OutputOptions struct {
+	NumParallelCollections   int    `long:"numParallelCollections" short:"j" description:"number of collections to restore in parallel" default:"4" default-mask:"-"`
+	NumInsertionWorkers      int    `long:"numInsertionWorkersPerCollection" description:"number of insertion workers to run concurrently per collection" default:"1" default-mask:"-"`
+	StopOnError              bool   `long:"stopOnError" description:"stop restoring if an error occurs"`
+	NoIndexRestore           bool   `long:"noIndexRestore" description:"don't restore indexes"`
+	NoOptionsRestore         bool   `long:"noOptionsRestore" description:"don't restore collection options"`
+	KeepIndexVersion         bool   `long:"keepIndexVersion" description:"don't update index version"`
+	MaintainInsertionOrder   bool   `long:"maintainInsertionOrder" description:"preserve order of documents during restoration"`
+	Drop                     bool   `long:"drop" description:"drop each collection before import"`
+	WriteConcern             string `long:"writeConcern" description:"write concern options e.g. --writeConcern majority, --writeConcern '{w: 3, j: true}'" default:"majority" default-mask:"-"`
+	NoOpTimeout              bool   `long:"noOplogTimeout" description:"nop trailing timeout in the oplog reader"`
+	TempUsersColl            string `long:"tempUsersColl" default:"tempusers" hidden:"true"`
+	TempRolesColl            string `long:"tempRolesColl" default:"temproles" hidden:"true"`
+	BypassDocumentValidation bool   `long:"bypassDocumentValidation" description:"bypass document validation"`
+	PreserveUUID             bool   `long:"preserveUUID" description:"preserve original collection UUIDs (requires drop if a collection with a different UUID already exists, and a server that supports FCV >= 3.6)"`
+	Checkpoint               bool   `long:"checkpoint" description:"write a resume journal recording restore progress, so a failed restore can pick up where it left off"`
+	ResumeFrom               string `long:"resumeFrom" value-name:"<path>" description:"resume a restore using the journal previously written at the given path"`
+	RequireDropForResume     bool   `long:"requireDropForResume" description:"when resuming, require --drop for any namespace whose checkpointed document count doesn't match the target collection"`
+	OplogParallelism         int    `long:"oplogParallelism" description:"number of oplog entries to apply concurrently during --oplogReplay" default:"1" default-mask:"-"`
+	DryRun                   bool   `long:"dryRun" description:"report what a restore would do, as a JSON plan on stdout, without writing anything to the target server"`
+}
+
+// Name returns a human-readable name for the output options.
+func (*OutputOptions) Name() string {
+	return "restore"
+}
+
+// NSOptions defines the set of options for configuring involved namespaces.
+type NSOptions struct {
+	DB         string   `short:"d" long:"db" value-name:"<database-name>" description:"database to use when restoring from a BSON file"`
+	Collection string   `short:"c" long:"collection" value-name:"<collection-name>" description:"collection to use when restoring from a BSON file"`
+	NSExclude  []string `long:"nsExclude" value-name:"<namespace-pattern>" description:"exclude matching namespaces"`
+	NSInclude  []string `long:"nsInclude" value-name:"<namespace-pattern>" description:"include matching namespaces"`
+	NSFrom     []string `long:"nsFrom" value-name:"<namespace-pattern>" description:"rename matching namespaces, must have matching nsTo"`
+	NSTo       []string `long:"nsTo" value-name:"<namespace-pattern>" description:"rename matched namespaces, must have matching nsFrom"`
+}
+
+// Name returns a human-readable name for the namespace options.
+func (*NSOptions) Name() string {
+	return "namespace"
+}
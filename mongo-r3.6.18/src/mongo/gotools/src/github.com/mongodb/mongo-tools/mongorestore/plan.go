@@ -0,0 +1,203 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NamespacePlan describes, for a single namespace, what a real restore
+// would do with it.
+type NamespacePlan struct {
+	Namespace         string   `json:"namespace"`
+	SourceFile        string   `json:"sourceFile,omitempty"`
+	EstimatedDocCount int64    `json:"estimatedDocCount"`
+	EstimatedBytes    int64    `json:"estimatedSizeBytes"`
+	CollectionExists  bool     `json:"collectionExists"`
+	UUID              string   `json:"uuid,omitempty"`
+	Indexes           []string `json:"indexesToBuild,omitempty"`
+	Warnings          []string `json:"warnings,omitempty"`
+}
+
+// RestorePlan is the structured output of a --dryRun restore: one entry per
+// namespace that would have been restored.
+type RestorePlan struct {
+	Namespaces []NamespacePlan `json:"namespaces"`
+}
+
+// planRestore builds a RestorePlan for every namespace restore.source
+// exposes, performing the same discovery, metadata parsing, index
+// validation, and existence/conflict checks a real restore would, but
+// issuing no writes. As a side effect it records in restore.knownCollections
+// every namespace whose target collection already exists; unlike a real
+// restore, which records each namespace it writes, it records none that
+// don't exist yet.
+func (restore *MongoRestore) planRestore() (*RestorePlan, error) {
+	namespaces, err := restore.source.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RestorePlan{}
+	for _, ns := range namespaces {
+		dbName, collName := splitNamespace(ns)
+
+		nsPlan, err := restore.planNamespace(ns, dbName, collName)
+		if err != nil {
+			return nil, fmt.Errorf("error planning %v: %v", ns, err)
+		}
+		if nsPlan.CollectionExists {
+			restore.noteKnownCollection(dbName, collName)
+		}
+		plan.Namespaces = append(plan.Namespaces, *nsPlan)
+	}
+	return plan, nil
+}
+
+// planNamespace builds the NamespacePlan for a single namespace.
+func (restore *MongoRestore) planNamespace(ns, dbName, collName string) (*NamespacePlan, error) {
+	meta, err := restore.readCollectionMetadata(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	exists, existingUUID, err := restore.collectionUUID(session, dbName, collName)
+	if err != nil {
+		return nil, err
+	}
+
+	docCount, size, err := restore.estimateNamespaceSize(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	nsPlan := &NamespacePlan{
+		Namespace:         ns,
+		SourceFile:        dbName + "/" + collName + ".bson",
+		EstimatedDocCount: docCount,
+		EstimatedBytes:    size,
+		CollectionExists:  exists,
+	}
+	if restore.OutputOptions.PreserveUUID && meta.UUID != "" {
+		nsPlan.UUID = meta.UUID
+	}
+	for _, idx := range meta.Indexes {
+		nsPlan.Indexes = append(nsPlan.Indexes, indexDisplayName(idx))
+	}
+
+	nsPlan.Warnings = restore.namespaceWarnings(dbName, collName, meta, exists, existingUUID)
+	return nsPlan, nil
+}
+
+// estimateNamespaceSize opens ns's BSON stream and counts its documents and
+// bytes. It's a full scan rather than a metadata lookup, since dump
+// metadata doesn't record a document count mongorestore can trust.
+func (restore *MongoRestore) estimateNamespaceSize(ns string) (docCount, size int64, err error) {
+	stream, err := restore.source.OpenBSON(ns)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stream.Close()
+
+	for {
+		raw, err := readBSONDocument(stream)
+		if err == io.EOF {
+			return docCount, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		docCount++
+		size += int64(len(raw))
+	}
+}
+
+// namespaceWarnings flags restore decisions worth surfacing to the
+// operator before they commit to them: an auth restore that will overwrite
+// existing users/roles, a view/collection mismatch, or a requested feature
+// the target's FCV can't support.
+func (restore *MongoRestore) namespaceWarnings(dbName, collName string, meta *CollectionMetadata, exists bool, existingUUID string) []string {
+	var warnings []string
+
+	if dbName == "admin" && (collName == restore.OutputOptions.TempUsersColl || collName == restore.OutputOptions.TempRolesColl) {
+		warnings = append(warnings, fmt.Sprintf(
+			"restoring users/roles will drop the temporary collection %v.%v once the merge into system.users/system.roles completes",
+			dbName, collName))
+	}
+
+	if viewOn, ok := lookupBSONKey(meta.Options, "viewOn"); ok {
+		if exists {
+			warnings = append(warnings, fmt.Sprintf(
+				"%v.%v is a view on %v, but a collection with that name already exists on the target", dbName, collName, viewOn))
+		}
+	}
+
+	if restore.OutputOptions.PreserveUUID && meta.UUID != "" {
+		fcvOK, err := restore.hasUUIDSupportForPlan()
+		if err == nil && !fcvOK {
+			warnings = append(warnings, fmt.Sprintf(
+				"--preserveUUID was requested for %v.%v, but the target's featureCompatibilityVersion doesn't support collection UUIDs", dbName, collName))
+		}
+		if exists && existingUUID != "" && existingUUID != meta.UUID && !restore.OutputOptions.Drop {
+			warnings = append(warnings, fmt.Sprintf(
+				"%v.%v already exists with a different UUID; --drop is required to apply the dump's UUID", dbName, collName))
+		}
+	}
+
+	return warnings
+}
+
+// hasUUIDSupportForPlan is a thin wrapper around hasUUIDSupport that opens
+// its own session, for use from plan construction where no session is
+// already in hand.
+func (restore *MongoRestore) hasUUIDSupportForPlan() (bool, error) {
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	return restore.hasUUIDSupport(session)
+}
+
+// lookupBSONKey returns the value of the named top-level element in doc, if
+// present.
+func lookupBSONKey(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// indexDisplayName renders an index the way mongorestore's plan output
+// describes it: its name if the dump recorded one, or its key pattern
+// otherwise.
+func indexDisplayName(idx IndexDocument) string {
+	if name, ok := idx.Options["name"].(string); ok && name != "" {
+		return name
+	}
+	return fmt.Sprintf("%v", idx.Key)
+}
+
+// writePlan marshals plan as indented JSON to stdout.
+func writePlan(plan *RestorePlan) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
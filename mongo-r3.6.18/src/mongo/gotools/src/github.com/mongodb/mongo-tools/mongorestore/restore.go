@@ -0,0 +1,446 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package mongorestore writes BSON data previously dumped with mongodump
+// back into a MongoDB instance.
+package mongorestore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"github.com/mongodb/mongo-tools/common/options"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MinBSONDocumentSize is the smallest possible size of a valid BSON document.
+const MinBSONDocumentSize = 5
+
+// MongoRestore is a container for the user-specified options and
+// internal state used to drive the restoration process.
+type MongoRestore struct {
+	ToolOptions   *options.ToolOptions
+	InputOptions  *InputOptions
+	OutputOptions *OutputOptions
+	NSOptions     *NSOptions
+
+	SessionProvider *db.SessionProvider
+
+	// TargetDirectory is the dump directory to restore from, or "-" to
+	// read a single collection from standard input.
+	TargetDirectory string
+
+	// InputReader is used in place of opening TargetDirectory when
+	// restoring a single collection from an arbitrary io.Reader (e.g.
+	// when TargetDirectory is "-").
+	InputReader io.Reader
+
+	// knownCollections caches, per database, the collection names that
+	// mongorestore has observed to already exist on the target server.
+	// It is populated lazily as namespaces are restored.
+	knownCollections map[string][]string
+
+	// journal records restore progress, one namespace at a time, so a
+	// killed or interrupted restore can resume without re-inserting
+	// documents already written to the target. It is non-nil only when
+	// --checkpoint or --resumeFrom was given.
+	journal *journal
+
+	// source is where namespace data is read from when TargetDirectory
+	// isn't "-"; it's resolved once, at the top of Restore, from
+	// TargetDirectory's scheme.
+	source RestoreSource
+
+	// crashAfterDocs is a test-only hook: when non-zero, insertDocuments
+	// returns errSimulatedCrash after inserting this many documents for
+	// the namespace currently being restored, simulating a process kill
+	// mid-restore so resume tests can exercise the checkpoint/resume path
+	// without an actual failpoint-triggered crash.
+	crashAfterDocs int
+}
+
+// checkpointBatchSize is the number of documents inserted between journal
+// checkpoints for a single namespace. It's a var, rather than a const, so
+// tests can shrink it to exercise checkpointing without restoring enormous
+// fixtures.
+var checkpointBatchSize = 1000
+
+// errSimulatedCrash is returned by insertDocuments when
+// MongoRestore.crashAfterDocs triggers; see its doc comment.
+var errSimulatedCrash = fmt.Errorf("simulated crash for resume testing")
+
+// Restore runs the mongorestore program.
+func (restore *MongoRestore) Restore() error {
+	if restore.knownCollections == nil {
+		restore.knownCollections = map[string][]string{}
+	}
+
+	if restore.TargetDirectory == "-" {
+		if restore.OutputOptions.DryRun {
+			return fmt.Errorf("--dryRun is not supported when restoring from stdin")
+		}
+		dbName := restore.NSOptions.DB
+		collName := restore.NSOptions.Collection
+		if dbName == "" || collName == "" {
+			return fmt.Errorf("-d and -c must be specified when restoring from stdin")
+		}
+		return restore.restoreNamespace(dbName, collName, restore.InputReader)
+	}
+
+	source, err := NewRestoreSource(restore.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	restore.source = source
+
+	if restore.OutputOptions.Checkpoint || restore.OutputOptions.ResumeFrom != "" {
+		journalPath := restore.OutputOptions.ResumeFrom
+		if journalPath == "" {
+			local, isLocal := source.(*localDirSource)
+			if !isLocal {
+				return fmt.Errorf("--checkpoint requires --resumeFrom when restoring from a remote source")
+			}
+			journalPath = filepath.Join(local.root, ".mongorestore.journal")
+		}
+		j, err := openJournal(journalPath)
+		if err != nil {
+			return fmt.Errorf("error opening checkpoint journal: %v", err)
+		}
+		defer j.Close()
+		restore.journal = j
+	}
+
+	if restore.OutputOptions.DryRun {
+		plan, err := restore.planRestore()
+		if err != nil {
+			return err
+		}
+		return writePlan(plan)
+	}
+
+	namespaces, err := source.ListNamespaces()
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		dbName, collName := splitNamespace(ns)
+		if err := restore.restoreNamespaceFromSource(ns, dbName, collName); err != nil {
+			if err == errSimulatedCrash {
+				return err
+			}
+			return fmt.Errorf("error restoring %v: %v", ns, err)
+		}
+	}
+
+	if err := restore.mergeUsersAndRoles(); err != nil {
+		return err
+	}
+
+	if restore.InputOptions.OplogReplay {
+		if err := restore.replayOplog(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayOplog reads the dump's oplog, via restore.source, and replays it.
+func (restore *MongoRestore) replayOplog() error {
+	oplog, err := restore.source.OplogReader()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("--oplogReplay was specified but the dump has no recorded oplog")
+		}
+		return err
+	}
+	defer oplog.Close()
+
+	log.Logvf(log.Always, "replaying oplog")
+	return restore.RestoreOplog(oplog)
+}
+
+// restoreNamespaceFromSource restores ns from restore.source, resuming from
+// a prior checkpoint when one is recorded in the journal. Byte-offset
+// resume is only available when the source is backed by local files, since
+// it relies on being able to seek and to re-hash a stable file on disk;
+// other sources can still skip namespaces the journal already marked
+// complete, just not fast-forward partway through one.
+func (restore *MongoRestore) restoreNamespaceFromSource(ns, dbName, collName string) error {
+	meta, err := restore.readCollectionMetadata(ns)
+	if err != nil {
+		return err
+	}
+
+	local, isLocal := restore.source.(*localDirSource)
+
+	var resumeOffset, resumeDocCount int64
+	if restore.journal != nil {
+		if entry, ok := restore.journal.Lookup(ns); ok {
+			if entry.Complete {
+				log.Logvf(log.Always, "skipping %v, already restored per checkpoint", ns)
+				restore.noteKnownCollection(dbName, collName)
+				return nil
+			}
+			if isLocal && entry.Offset > 0 {
+				resumable, err := restore.verifyResumable(local.path(ns), ns, entry)
+				if err != nil {
+					return err
+				}
+				if resumable {
+					resumeOffset, resumeDocCount = entry.Offset, entry.DocCount
+				}
+			}
+		}
+	}
+
+	bsonStream, err := restore.source.OpenBSON(ns)
+	if err != nil {
+		return err
+	}
+	defer bsonStream.Close()
+
+	if resumeOffset == 0 {
+		if err := restore.CreateCollection(dbName, collName, meta); err != nil {
+			return err
+		}
+	} else {
+		log.Logvf(log.Always, "resuming %v from checkpointed offset %v (%v docs already restored)",
+			ns, resumeOffset, resumeDocCount)
+		seeker, ok := bsonStream.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("cannot resume %v: its source doesn't support seeking", ns)
+		}
+		if _, err := seeker.Seek(resumeOffset, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking to checkpointed offset for %v: %v", ns, err)
+		}
+	}
+
+	var bsonPath string
+	if isLocal {
+		bsonPath = local.path(ns)
+	}
+	if err := restore.insertDocuments(dbName, collName, bsonStream, bsonPath, resumeOffset, resumeDocCount); err != nil {
+		return err
+	}
+
+	if restore.journal != nil {
+		if err := restore.journal.Record(journalEntry{Namespace: ns, Complete: true}); err != nil {
+			return err
+		}
+	}
+
+	return restore.CreateIndexes(dbName, collName, meta.Indexes)
+}
+
+// readCollectionMetadata loads ns's metadata from restore.source. A source
+// that has no metadata for ns (os.IsNotExist) isn't an error: not every
+// namespace carries one.
+func (restore *MongoRestore) readCollectionMetadata(ns string) (*CollectionMetadata, error) {
+	metaStream, err := restore.source.OpenMetadata(ns)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &CollectionMetadata{}, nil
+		}
+		return nil, fmt.Errorf("error opening metadata for %v: %v", ns, err)
+	}
+	defer metaStream.Close()
+
+	meta, err := parseMetadata(metaStream)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata for %v: %v", ns, err)
+	}
+	return meta, nil
+}
+
+// verifyResumable checks that ns can safely be fast-forwarded to
+// entry.Offset: the source file must be unchanged since the checkpoint was
+// written, and the target collection's document count must still match
+// what was recorded. A count mismatch means the target has diverged from
+// the checkpoint; resumable reports false (with a nil error) once the
+// caller should fall back to restoring ns from the beginning rather than
+// fast-forwarding into it.
+//
+// --requireDropForResume makes that divergence recoverable: as long as
+// --drop was also given, the diverged collection is dropped here so the
+// caller's ordinary from-scratch path re-creates it. Without
+// --requireDropForResume, a divergence is refused outright, since
+// inserting more documents into an already-diverged collection would just
+// compound it.
+func (restore *MongoRestore) verifyResumable(bsonPath, ns string, entry journalEntry) (resumable bool, err error) {
+	currentHash, err := hashFilePrefix(bsonPath, entry.Offset)
+	if err != nil {
+		return false, fmt.Errorf("error verifying checkpoint for %v: %v", ns, err)
+	}
+	if currentHash != entry.SourceHash {
+		return false, fmt.Errorf("refusing to resume %v: source file %v has changed since the checkpoint was recorded", ns, bsonPath)
+	}
+
+	dbName, collName := splitNamespace(ns)
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	count, err := session.DB(dbName).C(collName).Count()
+	if err != nil {
+		return false, err
+	}
+	if int64(count) == entry.DocCount {
+		return true, nil
+	}
+
+	if !restore.OutputOptions.RequireDropForResume {
+		return false, fmt.Errorf("cannot resume %v: target has %v documents but the checkpoint recorded %v; the target may have diverged",
+			ns, count, entry.DocCount)
+	}
+	if !restore.OutputOptions.Drop {
+		return false, fmt.Errorf("cannot resume %v: --requireDropForResume requires --drop to recover from a diverged target", ns)
+	}
+	log.Logvf(log.Always, "%v has diverged from its checkpoint (%v documents, expected %v); dropping and restoring from the beginning",
+		ns, count, entry.DocCount)
+	if err := session.DB(dbName).C(collName).DropCollection(); err != nil {
+		return false, fmt.Errorf("error dropping diverged collection %v: %v", ns, err)
+	}
+	return false, nil
+}
+
+// restoreNamespace restores a single namespace from an arbitrary reader,
+// used for the "-" (stdin) restore path. Checkpointing is not available on
+// this path, since stdin can't be re-read or hashed on resume.
+func (restore *MongoRestore) restoreNamespace(dbName, collName string, in io.Reader) error {
+	if err := restore.CreateCollection(dbName, collName, &CollectionMetadata{}); err != nil {
+		return err
+	}
+	return restore.insertDocuments(dbName, collName, in, "", 0, 0)
+}
+
+// insertDocuments streams raw BSON documents out of in and inserts them
+// into dbName.collName using a buffered bulk inserter. When bsonPath is
+// non-empty and restore.journal is set, progress is checkpointed every
+// checkpointBatchSize documents.
+func (restore *MongoRestore) insertDocuments(dbName, collName string, in io.Reader, bsonPath string, startOffset, startDocCount int64) error {
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	coll := session.DB(dbName).C(collName)
+	bulk := db.NewBufferedBulkInserter(coll, restore.OutputOptions.NumInsertionWorkers, !restore.OutputOptions.MaintainInsertionOrder)
+
+	ns := dbName + "." + collName
+	offset := startOffset
+	docCount := startDocCount
+	sinceCheckpoint := 0
+
+	for {
+		raw, err := readBSONDocument(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(raw))
+
+		var doc bson.Raw
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		if err := bulk.Insert(doc); err != nil {
+			return err
+		}
+		docCount++
+		sinceCheckpoint++
+
+		if restore.journal != nil && bsonPath != "" && sinceCheckpoint >= checkpointBatchSize {
+			if err := bulk.Flush(); err != nil {
+				return err
+			}
+			if err := restore.writeCheckpoint(ns, bsonPath, offset, docCount); err != nil {
+				return err
+			}
+			sinceCheckpoint = 0
+		}
+
+		if restore.crashAfterDocs > 0 && docCount-startDocCount >= int64(restore.crashAfterDocs) {
+			return errSimulatedCrash
+		}
+	}
+
+	if err := bulk.Flush(); err != nil {
+		return err
+	}
+
+	restore.noteKnownCollection(dbName, collName)
+	log.Logvf(log.Info, "finished restoring %v.%v", dbName, collName)
+	return nil
+}
+
+// writeCheckpoint records the current restore progress for ns in the
+// journal, hashing the source file up to offset so a later resume can
+// detect whether the file has changed underneath it.
+func (restore *MongoRestore) writeCheckpoint(ns, bsonPath string, offset, docCount int64) error {
+	hash, err := hashFilePrefix(bsonPath, offset)
+	if err != nil {
+		return err
+	}
+	return restore.journal.Record(journalEntry{
+		Namespace:  ns,
+		Offset:     offset,
+		SourceHash: hash,
+		DocCount:   docCount,
+	})
+}
+
+// splitNamespace splits a "db.collection" namespace string into its parts.
+func splitNamespace(ns string) (dbName, collName string) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return ns, ""
+	}
+	return ns[:i], ns[i+1:]
+}
+
+// noteKnownCollection records that collName has been observed to exist in
+// dbName, so that later conflict checks don't need to round-trip to the
+// server.
+func (restore *MongoRestore) noteKnownCollection(dbName, collName string) {
+	for _, existing := range restore.knownCollections[dbName] {
+		if existing == collName {
+			return
+		}
+	}
+	restore.knownCollections[dbName] = append(restore.knownCollections[dbName], collName)
+}
+
+// readBSONDocument reads a single raw BSON document (length-prefixed) off
+// of r.
+func readBSONDocument(r io.Reader) ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	size := int32(binary.LittleEndian.Uint32(sizeBuf))
+	if size < MinBSONDocumentSize {
+		return nil, fmt.Errorf("invalid BSON document length: %v", size)
+	}
+	buf := make([]byte, size)
+	copy(buf, sizeBuf)
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreSource abstracts where mongorestore reads a dump's contents from,
+// so that dumps on local disk and dumps hosted in a remote object store can
+// be restored through the same code path. TargetDirectory is resolved to a
+// RestoreSource once, up front, by NewRestoreSource.
+type RestoreSource interface {
+	// ListNamespaces returns every "db.collection" namespace available to
+	// restore from this source, in no particular order.
+	ListNamespaces() ([]string, error)
+
+	// OpenBSON opens the BSON document stream for ns. The caller is
+	// responsible for closing the returned reader.
+	OpenBSON(ns string) (io.ReadCloser, error)
+
+	// OpenMetadata opens the *.metadata.json contents for ns. It returns
+	// an error satisfying os.IsNotExist if ns has no recorded metadata.
+	OpenMetadata(ns string) (io.ReadCloser, error)
+
+	// OplogReader opens the oplog.bson stream for the dump. It returns an
+	// error satisfying os.IsNotExist if the dump has no oplog.
+	OplogReader() (io.ReadCloser, error)
+}
+
+// NewRestoreSource resolves target to a RestoreSource, dispatching on its
+// scheme: "s3://", "gs://", and "azblob://" address a remote object store,
+// and anything else is treated as a path to a local directory.
+func NewRestoreSource(target string) (RestoreSource, error) {
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		return newS3Source(target)
+	case strings.HasPrefix(target, "gs://"):
+		return newGCSSource(target)
+	case strings.HasPrefix(target, "azblob://"):
+		return newAzureBlobSource(target)
+	default:
+		return newLocalDirSource(target)
+	}
+}
+
+// localDirSource reads a dump laid out as a directory on local disk, the
+// classic mongodump/mongorestore format: <root>/<db>/<collection>.bson plus
+// a sibling <collection>.metadata.json, and an optional <root>/oplog.bson.
+type localDirSource struct {
+	root string
+}
+
+func newLocalDirSource(root string) (*localDirSource, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading target directory %v: %v", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("target %v is not a directory", root)
+	}
+	return &localDirSource{root: root}, nil
+}
+
+func (s *localDirSource) ListNamespaces() ([]string, error) {
+	dbDirs, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading target directory %v: %v", s.root, err)
+	}
+
+	var namespaces []string
+	for _, dbDir := range dbDirs {
+		if !dbDir.IsDir() {
+			continue
+		}
+		collFiles, err := ioutil.ReadDir(filepath.Join(s.root, dbDir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading database directory %v: %v", dbDir.Name(), err)
+		}
+		for _, collFile := range collFiles {
+			if !strings.HasSuffix(collFile.Name(), ".bson") {
+				continue
+			}
+			collName := strings.TrimSuffix(collFile.Name(), ".bson")
+			namespaces = append(namespaces, dbDir.Name()+"."+collName)
+		}
+	}
+	return namespaces, nil
+}
+
+func (s *localDirSource) OpenBSON(ns string) (io.ReadCloser, error) {
+	dbName, collName := splitNamespace(ns)
+	return os.Open(filepath.Join(s.root, dbName, collName+".bson"))
+}
+
+func (s *localDirSource) OpenMetadata(ns string) (io.ReadCloser, error) {
+	dbName, collName := splitNamespace(ns)
+	return os.Open(filepath.Join(s.root, dbName, collName+".metadata.json"))
+}
+
+func (s *localDirSource) OplogReader() (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.root, "oplog.bson"))
+}
+
+// path returns the on-disk BSON path for ns, for callers (like the
+// checkpoint journal) that need a stable path to seek and hash rather than
+// a fresh io.ReadCloser.
+func (s *localDirSource) path(ns string) string {
+	dbName, collName := splitNamespace(ns)
+	return filepath.Join(s.root, dbName, collName+".bson")
+}
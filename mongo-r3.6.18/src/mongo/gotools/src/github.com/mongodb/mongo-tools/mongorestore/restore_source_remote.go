@@ -0,0 +1,270 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errKeyNotFound wraps a provider-specific "object doesn't exist" error
+// into one that satisfies os.IsNotExist, the contract OpenMetadata and
+// OplogReader document on RestoreSource: readCollectionMetadata and
+// replayOplog both rely on it to tell a missing, optional file apart from
+// a real failure.
+func errKeyNotFound(key string) error {
+	return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+}
+
+// objectStoreSource is the shared implementation behind the S3, GCS, and
+// Azure Blob Storage RestoreSource variants: every one of them is, at
+// bottom, a flat namespace of objects under a bucket/container and prefix,
+// addressed the same way the local directory source addresses files, so
+// they share the key-naming logic and differ only in how a key is opened.
+type objectStoreSource struct {
+	bucket string
+	prefix string
+	open   func(key string) (io.ReadCloser, error)
+	list   func(prefix string) ([]string, error)
+}
+
+func (s *objectStoreSource) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(s.prefix, "/") + "/" + name
+}
+
+func (s *objectStoreSource) ListNamespaces() ([]string, error) {
+	keys, err := s.list(s.key(""))
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, s.key(""))
+		rel = strings.TrimPrefix(rel, "/")
+		if !strings.HasSuffix(rel, ".bson") {
+			continue
+		}
+		// rel is "<db>/<collection>.bson".
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		namespaces = append(namespaces, parts[0]+"."+strings.TrimSuffix(parts[1], ".bson"))
+	}
+	return namespaces, nil
+}
+
+func (s *objectStoreSource) OpenBSON(ns string) (io.ReadCloser, error) {
+	dbName, collName := splitNamespace(ns)
+	return s.open(s.key(dbName + "/" + collName + ".bson"))
+}
+
+func (s *objectStoreSource) OpenMetadata(ns string) (io.ReadCloser, error) {
+	dbName, collName := splitNamespace(ns)
+	return s.open(s.key(dbName + "/" + collName + ".metadata.json"))
+}
+
+func (s *objectStoreSource) OplogReader() (io.ReadCloser, error) {
+	return s.open(s.key("oplog.bson"))
+}
+
+// parseBucketURI splits a "<scheme>://<bucket>/<prefix>" URI into its
+// bucket and prefix components.
+func parseBucketURI(uri string) (bucket, prefix string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid URI %v: %v", uri, err)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("invalid URI %v: missing bucket", uri)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// newS3Source resolves an "s3://bucket/prefix" URI to a RestoreSource
+// backed by Amazon S3, or an S3-compatible store such as MinIO when
+// MONGORESTORE_S3_ENDPOINT names one, in which case path-style addressing
+// is used since path-style is what those endpoints typically expect.
+// Credentials are discovered the standard AWS SDK way: environment, shared
+// config, or the instance/task IAM role.
+func newS3Source(uri string) (RestoreSource, error) {
+	bucket, prefix, err := parseBucketURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := aws.NewConfig()
+	if endpoint := os.Getenv("MONGORESTORE_S3_ENDPOINT"); endpoint != "" {
+		// An S3-compatible endpoint (e.g. MinIO) only understands
+		// path-style addressing, not the virtual-hosted-style bucket
+		// subdomains real S3 defaults to.
+		awsConfig = awsConfig.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 session: %v", err)
+	}
+	client := s3.New(sess)
+
+	return &objectStoreSource{
+		bucket: bucket,
+		prefix: prefix,
+		open: func(key string) (io.ReadCloser, error) {
+			out, err := client.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+					return nil, errKeyNotFound(key)
+				}
+				return nil, err
+			}
+			return out.Body, nil
+		},
+		list: func(prefix string) ([]string, error) {
+			var keys []string
+			err := client.ListObjectsPages(&s3.ListObjectsInput{
+				Bucket: aws.String(bucket),
+				Prefix: aws.String(prefix),
+			}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+				for _, obj := range page.Contents {
+					keys = append(keys, aws.StringValue(obj.Key))
+				}
+				return true
+			})
+			return keys, err
+		},
+	}, nil
+}
+
+// newGCSSource resolves a "gs://bucket/prefix" URI to a RestoreSource
+// backed by Google Cloud Storage. Credentials are discovered via
+// GOOGLE_APPLICATION_CREDENTIALS or the ambient GCE/GKE service account.
+func newGCSSource(uri string) (RestoreSource, error) {
+	bucket, prefix, err := parseBucketURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCS client: %v", err)
+	}
+	bucketHandle := client.Bucket(bucket)
+
+	return &objectStoreSource{
+		bucket: bucket,
+		prefix: prefix,
+		open: func(key string) (io.ReadCloser, error) {
+			r, err := bucketHandle.Object(key).NewReader(ctx)
+			if err == storage.ErrObjectNotExist {
+				return nil, errKeyNotFound(key)
+			}
+			return r, err
+		},
+		list: func(prefix string) ([]string, error) {
+			var keys []string
+			it := bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+			for {
+				attrs, err := it.Next()
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				keys = append(keys, attrs.Name)
+			}
+			return keys, nil
+		},
+	}, nil
+}
+
+// azureStorageCredentials reads the account name and key mongorestore uses
+// to authenticate against Azure Blob Storage from the environment, the same
+// variables the az CLI and azcopy honor.
+func azureStorageCredentials() (accountName, accountKey string) {
+	return os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY")
+}
+
+// newAzureBlobSource resolves an "azblob://container/prefix" URI to a
+// RestoreSource backed by Azure Blob Storage. Credentials are discovered
+// via the AZURE_STORAGE_ACCOUNT / AZURE_STORAGE_KEY environment variables
+// as a shared key; a SAS token is not read.
+func newAzureBlobSource(uri string) (RestoreSource, error) {
+	container, prefix, err := parseBucketURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	accountName, accountKey := azureStorageCredentials()
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("error building Azure credential: %v", err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	containerURL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, container))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure container URL: %v", err)
+	}
+	containerClient := azblob.NewContainerURL(*containerURL, pipeline)
+	ctx := context.Background()
+
+	return &objectStoreSource{
+		bucket: container,
+		prefix: prefix,
+		open: func(key string) (io.ReadCloser, error) {
+			blobURL := containerClient.NewBlobURL(key)
+			resp, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+			if err != nil {
+				if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+					return nil, errKeyNotFound(key)
+				}
+				return nil, err
+			}
+			return resp.Body(azblob.RetryReaderOptions{}), nil
+		},
+		list: func(prefix string) ([]string, error) {
+			var keys []string
+			for marker := (azblob.Marker{}); marker.NotDone(); {
+				resp, err := containerClient.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+				if err != nil {
+					return nil, err
+				}
+				for _, blob := range resp.Segment.BlobItems {
+					keys = append(keys, blob.Name)
+				}
+				marker = resp.NextMarker
+			}
+			return keys, nil
+		},
+	}, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/log"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mergeUsersAndRoles folds a restored admin.tempusers/admin.temproles into
+// admin.system.users/admin.system.roles and drops the temporary
+// collections. Only namespaces that the dump itself names after the temp
+// collections are merged: a dump's admin.system.users and
+// admin.system.roles are restored like any other namespace, not staged in
+// the temp collections first.
+func (restore *MongoRestore) mergeUsersAndRoles() error {
+	if err := restore.mergeTempCollection(restore.OutputOptions.TempUsersColl, "system.users"); err != nil {
+		return err
+	}
+	return restore.mergeTempCollection(restore.OutputOptions.TempRolesColl, "system.roles")
+}
+
+// mergeTempCollection upserts every document in admin.tempColl into
+// admin.targetColl by _id, then drops tempColl. It's a no-op if tempColl
+// was never restored.
+func (restore *MongoRestore) mergeTempCollection(tempColl, targetColl string) error {
+	if tempColl == "" {
+		return nil
+	}
+	if !restore.isKnownCollection("admin", tempColl) {
+		return nil
+	}
+
+	session, err := restore.SessionProvider.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	adminDB := session.DB("admin")
+	temp := adminDB.C(tempColl)
+	target := adminDB.C(targetColl)
+
+	iter := temp.Find(nil).Iter()
+	var doc bson.M
+	for iter.Next(&doc) {
+		id, ok := doc["_id"]
+		if !ok {
+			continue
+		}
+		if _, err := target.UpsertId(id, doc); err != nil {
+			iter.Close()
+			return fmt.Errorf("error merging admin.%v into admin.%v: %v", tempColl, targetColl, err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("error reading admin.%v: %v", tempColl, err)
+	}
+
+	log.Logvf(log.Always, "merged admin.%v into admin.%v", tempColl, targetColl)
+	if err := temp.DropCollection(); err != nil {
+		return fmt.Errorf("error dropping admin.%v after merge: %v", tempColl, err)
+	}
+	return nil
+}
+
+// isKnownCollection reports whether collName in dbName has been observed
+// to exist by this restore: it wrote to it, found it already marked
+// complete in the checkpoint journal, or (in a dry run) found it on the
+// target.
+func (restore *MongoRestore) isKnownCollection(dbName, collName string) bool {
+	for _, existing := range restore.knownCollections[dbName] {
+		if existing == collName {
+			return true
+		}
+	}
+	return false
+}